@@ -0,0 +1,200 @@
+package ipisp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	cacheResponseBucket = []byte("responses")
+	cacheErrorBucket    = []byte("errors")
+)
+
+type cacheEntry struct {
+	Range   *net.IPNet
+	Resp    Response
+	Expires time.Time
+}
+
+type cacheErrorEntry struct {
+	Range   *net.IPNet
+	Err     string
+	Expires time.Time
+}
+
+//boltCache is the disk tier of the cache: a BoltDB-backed Cache that
+//survives process restarts. BoltDB's own keys are ordered bytes, not IP
+//ranges, so longest-prefix matching is done over an in-memory index that's
+//built from the database at open time and kept in sync on every write. The
+//index is a prefixTrie, not a linear scan, so a Lookup stays fast once
+//Prewarm has loaded hundreds of thousands of prefixes from a RIB dump
+type boltCache struct {
+	db *bbolt.DB
+
+	mu         sync.RWMutex
+	entries    map[string]cacheEntry
+	errs       map[string]cacheErrorEntry
+	entriesIdx *prefixTrie
+	errsIdx    *prefixTrie
+}
+
+//NewBoltCache opens (creating if necessary) a BoltDB-backed Cache at path
+func NewBoltCache(path string) (*boltCache, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: Timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(cacheResponseBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(cacheErrorBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &boltCache{
+		db:         db,
+		entries:    make(map[string]cacheEntry),
+		errs:       make(map[string]cacheErrorEntry),
+		entriesIdx: newPrefixTrie(),
+		errsIdx:    newPrefixTrie(),
+	}
+	if err = c.loadIndex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *boltCache) loadIndex() error {
+	return c.db.View(func(tx *bbolt.Tx) error {
+		err := tx.Bucket(cacheResponseBucket).ForEach(func(k, v []byte) error {
+			var e cacheEntry
+			if err := gobDecode(v, &e); err != nil {
+				return err
+			}
+			key := string(k)
+			c.entries[key] = e
+			c.entriesIdx.insert(e.Range, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(cacheErrorBucket).ForEach(func(k, v []byte) error {
+			var e cacheErrorEntry
+			if err := gobDecode(v, &e); err != nil {
+				return err
+			}
+			key := string(k)
+			c.errs[key] = e
+			c.errsIdx.insert(e.Range, key)
+			return nil
+		})
+	})
+}
+
+func (c *boltCache) Lookup(ip net.IP) (*Response, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range c.entriesIdx.matchPath(ip) {
+		e, ok := c.entries[key]
+		if !ok || now.After(e.Expires) {
+			continue
+		}
+		resp := e.Resp
+		return &resp, true
+	}
+	return nil, false
+}
+
+func (c *boltCache) Store(resp Response, ttl time.Duration) error {
+	if resp.Range == nil {
+		return errors.New("cache: response has no Range to key on")
+	}
+
+	e := cacheEntry{Range: resp.Range, Resp: resp, Expires: time.Now().Add(ttl)}
+	data, err := gobEncode(e)
+	if err != nil {
+		return err
+	}
+	key := resp.Range.String()
+
+	if err := c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(cacheResponseBucket).Put([]byte(key), data)
+	}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = e
+	c.entriesIdx.insert(resp.Range, key)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *boltCache) LookupError(ip net.IP) (error, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range c.errsIdx.matchPath(ip) {
+		e, ok := c.errs[key]
+		if !ok || now.After(e.Expires) {
+			continue
+		}
+		return errors.New(e.Err), true
+	}
+	return nil, false
+}
+
+func (c *boltCache) StoreError(rng *net.IPNet, lookupErr error, ttl time.Duration) error {
+	e := cacheErrorEntry{Range: rng, Err: lookupErr.Error(), Expires: time.Now().Add(ttl)}
+	data, err := gobEncode(e)
+	if err != nil {
+		return err
+	}
+	key := rng.String()
+
+	if err := c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(cacheErrorBucket).Put([]byte(key), data)
+	}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.errs[key] = e
+	c.errsIdx.insert(rng, key)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *boltCache) Close() error {
+	return c.db.Close()
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,26 @@
+package ipisp
+
+import (
+	"net"
+	"time"
+)
+
+//Cache stores Response values keyed by the CIDR Range they cover, so a
+//cachingClient can answer a LookupIP for any address inside a previously
+//seen range without going back out to Cymru. Implementations match by
+//longest prefix: if both a /16 and a /24 covering ip are cached, the /24
+//wins
+type Cache interface {
+	//Lookup returns the cached Response whose Range most specifically
+	//contains ip, and reports ok=false on a miss or an expired entry
+	Lookup(ip net.IP) (resp *Response, ok bool)
+	//Store caches resp against its own Range, valid until ttl elapses
+	Store(resp Response, ttl time.Duration) error
+
+	//LookupError returns a negatively-cached lookup failure covering ip, if any
+	LookupError(ip net.IP) (err error, ok bool)
+	//StoreError negatively caches a lookup failure for rng, valid until ttl elapses
+	StoreError(rng *net.IPNet, err error, ttl time.Duration) error
+
+	Close() error
+}
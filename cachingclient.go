@@ -0,0 +1,178 @@
+package ipisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+//DefaultCacheTTL is how long a cachingClient trusts a cached Response, or a
+//negatively-cached lookup failure, before re-querying the wrapped Client
+const DefaultCacheTTL = 24 * time.Hour
+
+//CachingOption configures a cachingClient constructed by NewCachingClient
+type CachingOption func(*cachingClient)
+
+//WithCacheTTL overrides DefaultCacheTTL
+func WithCacheTTL(ttl time.Duration) CachingOption {
+	return func(c *cachingClient) {
+		c.ttl = ttl
+	}
+}
+
+//cachingClient wraps a Client so that LookupIP first walks cache for a
+//range already covering ip, only falling back to inner on a miss. Cymru
+//rate-limits heavy users, and most IPs a caller looks up fall inside a
+//range a previous lookup already returned, so this avoids hitting the
+//network at all for the common case
+type cachingClient struct {
+	inner Client
+	cache Cache
+	ttl   time.Duration
+}
+
+//NewCachingClient wraps inner, an already-constructed whoisClient or
+//dnsClient, with cache
+func NewCachingClient(inner Client, cache Cache, opts ...CachingOption) *cachingClient {
+	c := &cachingClient{inner: inner, cache: cache, ttl: DefaultCacheTTL}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+//LookupIP is a context.Background() proxy of LookupIPContext
+func (c *cachingClient) LookupIP(ip net.IP) (*Response, error) {
+	return c.LookupIPContext(context.Background(), ip)
+}
+
+//LookupIPContext serves ip from cache when a previously-seen range covers
+//it, and only queries inner on a miss, caching whatever it gets back before
+//returning. Only a genuine Cymru *CymruError is negatively cached: a
+//context error or a transport failure says nothing about whether ip
+//exists, and caching those would poison ip for the full ttl after a single
+//slow or interrupted call
+func (c *cachingClient) LookupIPContext(ctx context.Context, ip net.IP) (*Response, error) {
+	if resp, ok := c.cache.Lookup(ip); ok {
+		return resp, nil
+	}
+	if err, ok := c.cache.LookupError(ip); ok {
+		return nil, err
+	}
+
+	resp, err := c.inner.LookupIPContext(ctx, ip)
+	if err != nil {
+		var cymruErr *CymruError
+		if errors.As(err, &cymruErr) {
+			c.cache.StoreError(hostRange(ip), err, c.ttl)
+		}
+		return nil, err
+	}
+
+	c.cache.Store(*resp, c.ttl)
+	return resp, nil
+}
+
+//LookupIPs is a context.Background() proxy of LookupIPsContext
+func (c *cachingClient) LookupIPs(ips []net.IP) ([]Response, error) {
+	return c.LookupIPsContext(context.Background(), ips)
+}
+
+//LookupIPsContext behaves like LookupIPContext, called once per IP
+func (c *cachingClient) LookupIPsContext(ctx context.Context, ips []net.IP) ([]Response, error) {
+	ret := make([]Response, 0, len(ips))
+	for _, ip := range ips {
+		resp, err := c.LookupIPContext(ctx, ip)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, *resp)
+	}
+	return ret, nil
+}
+
+//LookupASN is uncached: ASN lookups carry no CIDR Range to key a cache
+//entry on, so it's a direct proxy of inner.LookupASN
+func (c *cachingClient) LookupASN(asn ASN) (*Response, error) {
+	return c.inner.LookupASN(asn)
+}
+
+//LookupASNContext is a direct, uncached proxy of inner.LookupASNContext
+func (c *cachingClient) LookupASNContext(ctx context.Context, asn ASN) (*Response, error) {
+	return c.inner.LookupASNContext(ctx, asn)
+}
+
+//LookupASNs is a direct, uncached proxy of inner.LookupASNs
+func (c *cachingClient) LookupASNs(asns []ASN) ([]Response, error) {
+	return c.inner.LookupASNs(asns)
+}
+
+//LookupASNsContext is a direct, uncached proxy of inner.LookupASNsContext
+func (c *cachingClient) LookupASNsContext(ctx context.Context, asns []ASN) ([]Response, error) {
+	return c.inner.LookupASNsContext(ctx, asns)
+}
+
+//PrewarmError reports the prefixes Prewarm failed to look up, alongside how
+//many it warmed successfully. A bulk prewarm from a full RIB dump shouldn't
+//abort over one rate-limited or malformed prefix partway through, so
+//Prewarm keeps going and returns every failure together at the end
+type PrewarmError struct {
+	//Succeeded is how many of the given prefixes were looked up successfully
+	Succeeded int
+	//Failed maps a failed prefix to the error looking it up returned
+	Failed map[*net.IPNet]error
+}
+
+func (e *PrewarmError) Error() string {
+	return fmt.Sprintf("ipisp: prewarm failed for %d of %d prefixes", len(e.Failed), e.Succeeded+len(e.Failed))
+}
+
+//Prewarm bulk-loads cache by looking up each prefix's network address
+//through inner, e.g. from a full RIB dump, so later LookupIPs against
+//addresses in those ranges are served from cache without touching Cymru.
+//It keeps going past a failed prefix rather than aborting the whole batch,
+//returning a *PrewarmError listing every failure once it's worked through
+//all of prefixes
+func (c *cachingClient) Prewarm(ctx context.Context, prefixes []*net.IPNet) error {
+	var failed map[*net.IPNet]error
+	succeeded := 0
+
+	for _, prefix := range prefixes {
+		if _, err := c.LookupIPContext(ctx, prefix.IP); err != nil {
+			if failed == nil {
+				failed = make(map[*net.IPNet]error)
+			}
+			failed[prefix] = err
+			continue
+		}
+		succeeded++
+	}
+
+	if len(failed) > 0 {
+		return &PrewarmError{Succeeded: succeeded, Failed: failed}
+	}
+	return nil
+}
+
+//Close closes both inner and the cache
+func (c *cachingClient) Close() error {
+	err := c.inner.Close()
+	if cerr := c.cache.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//hostRange returns the narrowest possible range covering a single address,
+//used to negatively cache a lookup failure when we don't know the real
+//Range a successful lookup for ip would have returned
+func hostRange(ip net.IP) *net.IPNet {
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	mask := net.CIDRMask(bits, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
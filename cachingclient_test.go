@@ -0,0 +1,148 @@
+package ipisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+//fakeClient is a minimal Client whose LookupIPContext returns whatever
+//err/resp it's given, or defers to lookupFunc when set, for exercising
+//cachingClient's error classification and Prewarm's per-prefix handling
+type fakeClient struct {
+	err        error
+	resp       *Response
+	lookupFunc func(ip net.IP) (*Response, error)
+}
+
+func (f *fakeClient) LookupIPs(ips []net.IP) ([]Response, error) { return nil, nil }
+func (f *fakeClient) LookupIPsContext(ctx context.Context, ips []net.IP) ([]Response, error) {
+	return nil, nil
+}
+func (f *fakeClient) LookupIP(ip net.IP) (*Response, error) {
+	return f.LookupIPContext(context.Background(), ip)
+}
+func (f *fakeClient) LookupIPContext(ctx context.Context, ip net.IP) (*Response, error) {
+	if f.lookupFunc != nil {
+		return f.lookupFunc(ip)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.resp, nil
+}
+func (f *fakeClient) LookupASNs(asns []ASN) ([]Response, error) { return nil, nil }
+func (f *fakeClient) LookupASNsContext(ctx context.Context, asns []ASN) ([]Response, error) {
+	return nil, nil
+}
+func (f *fakeClient) LookupASN(asn ASN) (*Response, error) { return nil, nil }
+func (f *fakeClient) LookupASNContext(ctx context.Context, asn ASN) (*Response, error) {
+	return nil, nil
+}
+func (f *fakeClient) Close() error { return nil }
+
+//fakeCache is a minimal Cache that records how many times StoreError is
+//called, so tests can assert on what cachingClient chose to negatively cache
+type fakeCache struct {
+	errStored int
+}
+
+func (c *fakeCache) Lookup(ip net.IP) (*Response, bool)           { return nil, false }
+func (c *fakeCache) Store(resp Response, ttl time.Duration) error { return nil }
+func (c *fakeCache) LookupError(ip net.IP) (error, bool)          { return nil, false }
+func (c *fakeCache) StoreError(rng *net.IPNet, err error, ttl time.Duration) error {
+	c.errStored++
+	return nil
+}
+func (c *fakeCache) Close() error { return nil }
+
+//TestCachingClientDoesNotCacheTransportErrors guards against a context or
+//transport error getting negatively cached: neither says the IP doesn't
+//exist, and caching either would fail every later lookup for ip from cache
+//for the full ttl, even with a fresh context.Background() call
+func TestCachingClientDoesNotCacheTransportErrors(t *testing.T) {
+	inner := &fakeClient{err: errors.New("read tcp: connection reset by peer")}
+	cache := &fakeCache{}
+	c := NewCachingClient(inner, cache)
+
+	if _, err := c.LookupIPContext(context.Background(), net.ParseIP("8.8.8.8")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if cache.errStored != 0 {
+		t.Fatalf("transport error should not be negatively cached, got %d StoreError calls", cache.errStored)
+	}
+}
+
+func TestCachingClientDoesNotCacheContextErrors(t *testing.T) {
+	inner := &fakeClient{err: context.DeadlineExceeded}
+	cache := &fakeCache{}
+	c := NewCachingClient(inner, cache)
+
+	if _, err := c.LookupIPContext(context.Background(), net.ParseIP("8.8.8.8")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if cache.errStored != 0 {
+		t.Fatalf("context error should not be negatively cached, got %d StoreError calls", cache.errStored)
+	}
+}
+
+//TestCachingClientCachesCymruErrors checks that a genuine Cymru negative
+//response still gets negatively cached as before
+func TestCachingClientCachesCymruErrors(t *testing.T) {
+	inner := &fakeClient{err: &CymruError{msg: "no such IP"}}
+	cache := &fakeCache{}
+	c := NewCachingClient(inner, cache)
+
+	if _, err := c.LookupIPContext(context.Background(), net.ParseIP("8.8.8.8")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if cache.errStored != 1 {
+		t.Fatalf("expected the Cymru error to be negatively cached, got %d StoreError calls", cache.errStored)
+	}
+}
+
+//TestCachingClientPrewarmAggregatesErrors checks that Prewarm keeps going
+//past a failed prefix and reports every failure together, rather than
+//aborting the whole batch over the first one
+func TestCachingClientPrewarmAggregatesErrors(t *testing.T) {
+	prefixes := make([]*net.IPNet, 0, 4)
+	shouldFail := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		_, n, err := net.ParseCIDR(fmt.Sprintf("10.0.%d.0/24", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefixes = append(prefixes, n)
+		if i%2 == 0 {
+			shouldFail[n.String()] = true
+		}
+	}
+
+	inner := &fakeClient{
+		lookupFunc: func(ip net.IP) (*Response, error) {
+			for _, p := range prefixes {
+				if p.IP.Equal(ip) && shouldFail[p.String()] {
+					return nil, errors.New("simulated rate limit")
+				}
+			}
+			return &Response{}, nil
+		},
+	}
+	cache := &fakeCache{}
+	c := NewCachingClient(inner, cache)
+
+	err := c.Prewarm(context.Background(), prefixes)
+	if err == nil {
+		t.Fatal("expected a *PrewarmError")
+	}
+	var pErr *PrewarmError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("expected *PrewarmError, got %T", err)
+	}
+	if pErr.Succeeded != 2 || len(pErr.Failed) != 2 {
+		t.Fatalf("expected 2 succeeded and 2 failed, got %d succeeded, %d failed", pErr.Succeeded, len(pErr.Failed))
+	}
+}
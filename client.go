@@ -0,0 +1,22 @@
+package ipisp
+
+import (
+	"context"
+	"net"
+)
+
+//Client is the lookup surface shared by whoisClient and dnsClient. It's the
+//interface NewCachingClient wraps, so either backend can be cached the same way
+type Client interface {
+	LookupIPs(ips []net.IP) ([]Response, error)
+	LookupIPsContext(ctx context.Context, ips []net.IP) ([]Response, error)
+	LookupIP(ip net.IP) (*Response, error)
+	LookupIPContext(ctx context.Context, ip net.IP) (*Response, error)
+
+	LookupASNs(asns []ASN) ([]Response, error)
+	LookupASNsContext(ctx context.Context, asns []ASN) ([]Response, error)
+	LookupASN(asn ASN) (*Response, error)
+	LookupASNContext(ctx context.Context, asn ASN) (*Response, error)
+
+	Close() error
+}
@@ -1,6 +1,7 @@
 package ipisp
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -11,17 +12,34 @@ import (
 const hexDigit = "0123456789abcdef"
 
 type dnsClient struct {
+	resolver Resolver
 }
 
-func NewDnsClient() (client *dnsClient, err error) {
-	return &dnsClient{}, nil
+//NewDnsClient returns a client that resolves IPs and ASNs against Cymru's
+//DNS interface. By default it uses the Go stdlib resolver; pass WithResolver
+//or PreferGo to change that
+func NewDnsClient(opts ...Option) (client *dnsClient, err error) {
+	client = &dnsClient{
+		resolver: &goResolver{r: net.DefaultResolver},
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client, nil
 }
 
+//LookupIPs is a context.Background() proxy of LookupIPsContext
 func (c *dnsClient) LookupIPs(ips []net.IP) ([]Response, error) {
-	ret := make([]Response, len(ips))
+	return c.LookupIPsContext(context.Background(), ips)
+}
+
+//LookupIPsContext behaves like LookupIPs but returns ctx.Err() as soon
+//as ctx is cancelled, instead of blocking until every IP is looked up
+func (c *dnsClient) LookupIPsContext(ctx context.Context, ips []net.IP) ([]Response, error) {
+	ret := make([]Response, 0, len(ips))
 
 	for _, ip := range ips {
-		resp, err := c.LookupIP(ip)
+		resp, err := c.LookupIPContext(ctx, ip)
 		if err != nil {
 			return ret, err
 		}
@@ -30,9 +48,23 @@ func (c *dnsClient) LookupIPs(ips []net.IP) ([]Response, error) {
 	return ret, nil
 }
 
+//LookupIP is a context.Background() proxy of LookupIPContext
 func (c *dnsClient) LookupIP(ip net.IP) (*Response, error) {
+	return c.LookupIPContext(context.Background(), ip)
+}
+
+//LookupIPContext behaves like LookupIP but returns ctx.Err() as soon as
+//ctx is cancelled, instead of blocking until a response is received
+func (c *dnsClient) LookupIPContext(ctx context.Context, ip net.IP) (*Response, error) {
 	lookupName, err := c.getLookupName(ip)
-	txts, err := net.LookupTXT(lookupName)
+	if err != nil {
+		return nil, err
+	}
+
+	txts, err := c.resolver.LookupTXT(ctx, lookupName)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +107,10 @@ func (c *dnsClient) LookupIP(ip net.IP) (*Response, error) {
 			}
 		}
 
-		asnResponse, err := c.LookupASN(ret.ASN)
+		asnResponse, err := c.LookupASNContext(ctx, ret.ASN)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Could not retrieve ASN (%s): %s", ret.ASN.String(), err.Error())
 		}
@@ -89,11 +124,18 @@ func (c *dnsClient) LookupIP(ip net.IP) (*Response, error) {
 	return nil, fmt.Errorf("No records found")
 }
 
+//LookupASNs is a context.Background() proxy of LookupASNsContext
 func (c *dnsClient) LookupASNs(asns []ASN) ([]Response, error) {
-	ret := make([]Response, len(asns))
+	return c.LookupASNsContext(context.Background(), asns)
+}
+
+//LookupASNsContext behaves like LookupASNs but returns ctx.Err() as soon
+//as ctx is cancelled, instead of blocking until every ASN is looked up
+func (c *dnsClient) LookupASNsContext(ctx context.Context, asns []ASN) ([]Response, error) {
+	ret := make([]Response, 0, len(asns))
 
 	for _, asn := range asns {
-		resp, err := c.LookupASN(asn)
+		resp, err := c.LookupASNContext(ctx, asn)
 		if err != nil {
 			return ret, err
 		}
@@ -102,8 +144,18 @@ func (c *dnsClient) LookupASNs(asns []ASN) ([]Response, error) {
 	return ret, nil
 }
 
+//LookupASN is a context.Background() proxy of LookupASNContext
 func (c *dnsClient) LookupASN(asn ASN) (*Response, error) {
-	txts, err := net.LookupTXT(asn.String() + ".asn.cymru.com")
+	return c.LookupASNContext(context.Background(), asn)
+}
+
+//LookupASNContext behaves like LookupASN but returns ctx.Err() as soon
+//as ctx is cancelled, instead of blocking until a response is received
+func (c *dnsClient) LookupASNContext(ctx context.Context, asn ASN) (*Response, error) {
+	txts, err := c.resolver.LookupTXT(ctx, asn.String()+".asn.cymru.com")
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,128 @@
+package ipisp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+type lruItem struct {
+	key    string
+	rng    *net.IPNet
+	resp   Response
+	expiry time.Time
+}
+
+//lruCache is an in-memory LRU tier sitting in front of a slower backing
+//Cache, typically a boltCache. Positive lookups are served from memory
+//when possible; negative (error) lookups and all writes pass straight
+//through to next, since failures are cheap to recheck on disk and aren't
+//usually hot enough to earn memory. Ranges are indexed by a prefixTrie
+//rather than scanned linearly, so a busy cache holding a full RIB dump
+//still answers a Lookup in time proportional to the address width
+type lruCache struct {
+	capacity int
+	next     Cache
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	idx   *prefixTrie
+}
+
+//NewLRUCache wraps next with an in-memory tier holding up to capacity entries
+func NewLRUCache(capacity int, next Cache) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		next:     next,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element, capacity),
+		idx:      newPrefixTrie(),
+	}
+}
+
+func (c *lruCache) Lookup(ip net.IP) (*Response, bool) {
+	c.mu.Lock()
+	now := time.Now()
+	for _, key := range c.idx.matchPath(ip) {
+		el, ok := c.items[key]
+		if !ok {
+			continue
+		}
+		it := el.Value.(*lruItem)
+		if now.After(it.expiry) {
+			continue
+		}
+		c.ll.MoveToFront(el)
+		resp := it.resp
+		c.mu.Unlock()
+		return &resp, true
+	}
+	c.mu.Unlock()
+
+	resp, ok := c.next.Lookup(ip)
+	if ok {
+		//next.Lookup doesn't tell us the entry's remaining TTL, so promoted
+		//entries get a conservative fixed lifetime in the memory tier; the
+		//disk tier remains the source of truth for actual expiry
+		c.insert(*resp, lruPromotionTTL)
+	}
+	return resp, ok
+}
+
+func (c *lruCache) Store(resp Response, ttl time.Duration) error {
+	if err := c.next.Store(resp, ttl); err != nil {
+		return err
+	}
+	c.insert(resp, ttl)
+	return nil
+}
+
+//lruPromotionTTL bounds how long a response pulled up from the disk tier on
+//a memory-tier miss stays in memory before it's evicted again
+const lruPromotionTTL = 10 * time.Minute
+
+func (c *lruCache) insert(resp Response, ttl time.Duration) {
+	if resp.Range == nil || c.capacity <= 0 {
+		return
+	}
+	key := resp.Range.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruItem).resp = resp
+		el.Value.(*lruItem).expiry = time.Now().Add(ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&lruItem{key: key, rng: resp.Range, resp: resp, expiry: time.Now().Add(ttl)})
+	c.items[key] = el
+	c.idx.insert(resp.Range, key)
+
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		oi := oldest.Value.(*lruItem)
+		delete(c.items, oi.key)
+		c.idx.remove(oi.rng)
+	}
+}
+
+func (c *lruCache) LookupError(ip net.IP) (error, bool) {
+	return c.next.LookupError(ip)
+}
+
+func (c *lruCache) StoreError(rng *net.IPNet, err error, ttl time.Duration) error {
+	return c.next.StoreError(rng, err, ttl)
+}
+
+func (c *lruCache) Close() error {
+	return c.next.Close()
+}
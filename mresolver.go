@@ -0,0 +1,136 @@
+package ipisp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+//defaultEdns0BufSize is the UDP payload size advertised when EDNS0 is
+//enabled but the caller hasn't picked one explicitly
+const defaultEdns0BufSize = 4096
+
+//miekgResolver is a Resolver backed by github.com/miekg/dns. Unlike the
+//stdlib resolver it lets callers pick the upstream nameservers, the
+//transport, and EDNS0 behaviour, which is what's needed to reliably read
+//Cymru's pipe-delimited TXT payloads through resolvers that otherwise
+//mangle or truncate them
+type miekgResolver struct {
+	servers []string
+	retries int
+	edns0   bool
+	bufsize uint16
+	dnssec  bool
+	client  *dns.Client
+}
+
+//ResolverOption configures a miekgResolver constructed by NewMiekgResolver
+type ResolverOption func(*miekgResolver)
+
+//WithServers sets the upstream nameservers to query, each as "host:port".
+//They are tried in order until one answers
+func WithServers(servers ...string) ResolverOption {
+	return func(r *miekgResolver) {
+		r.servers = servers
+	}
+}
+
+//WithTransport selects the transport used to reach the servers: "udp"
+//(the default), "tcp", or "tcp-tls" for DNS-over-TLS
+func WithTransport(proto string) ResolverOption {
+	return func(r *miekgResolver) {
+		if proto == "udp" {
+			proto = ""
+		}
+		r.client.Net = proto
+	}
+}
+
+//WithTimeout sets the per-query timeout passed to the underlying dns.Client
+func WithTimeout(d time.Duration) ResolverOption {
+	return func(r *miekgResolver) {
+		r.client.Timeout = d
+	}
+}
+
+//WithRetries sets how many additional times each server is tried after a
+//failed exchange, before the resolver gives up and returns the last error
+func WithRetries(n int) ResolverOption {
+	return func(r *miekgResolver) {
+		r.retries = n
+	}
+}
+
+//WithEDNS0 enables EDNS0, advertising bufsize as the UDP payload size and
+//setting the DNSSEC OK (DO) bit when dnssec is true. With dnssec set,
+//LookupTXT also rejects any answer that comes back without the resolver's
+//AD (authenticated data) bit set, since requesting DNSSEC records without
+//checking that bit would otherwise accept an unvalidated response exactly
+//as readily as a validated one
+func WithEDNS0(bufsize uint16, dnssec bool) ResolverOption {
+	return func(r *miekgResolver) {
+		r.edns0 = true
+		r.bufsize = bufsize
+		r.dnssec = dnssec
+	}
+}
+
+//NewMiekgResolver returns a Resolver that queries the given nameservers
+//directly via github.com/miekg/dns instead of going through the host's
+//configured resolver. Pass it to NewDnsClient via WithResolver
+func NewMiekgResolver(opts ...ResolverOption) *miekgResolver {
+	r := &miekgResolver{
+		servers: []string{"8.8.8.8:53"},
+		retries: 1,
+		bufsize: defaultEdns0BufSize,
+		client:  &dns.Client{Timeout: Timeout},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *miekgResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	if r.edns0 {
+		m.SetEdns0(r.bufsize, r.dnssec)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		for _, server := range r.servers {
+			resp, _, err := r.client.ExchangeContext(ctx, m, server)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if resp.Rcode != dns.RcodeSuccess {
+				lastErr = fmt.Errorf("miekg resolver: %s answered %s", server, dns.RcodeToString[resp.Rcode])
+				continue
+			}
+			if r.dnssec && !resp.AuthenticatedData {
+				lastErr = fmt.Errorf("miekg resolver: %s did not return a DNSSEC-authenticated answer", server)
+				continue
+			}
+
+			txts := make([]string, 0, len(resp.Answer))
+			for _, rr := range resp.Answer {
+				if txt, ok := rr.(*dns.TXT); ok {
+					txts = append(txts, strings.Join(txt.Txt, ""))
+				}
+			}
+			return txts, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,67 @@
+package ipisp
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+//startFakeDNSServer answers every TXT query with a single "hello" record,
+//setting the AD bit according to authenticated, so tests can exercise both
+//a validated and an unvalidated DNSSEC response
+func startFakeDNSServer(t *testing.T, authenticated bool) (addr string, shutdown func()) {
+	t.Helper()
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.AuthenticatedData = authenticated
+		rr, err := dns.NewRR(r.Question[0].Name + " 60 IN TXT \"hello\"")
+		if err == nil {
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+//TestMiekgResolverRejectsUnauthenticated guards against LookupTXT returning
+//a DNSSEC-requested answer that the server didn't actually authenticate:
+//setting the DO bit on the query alone doesn't validate anything unless the
+//response's AD bit is also checked
+func TestMiekgResolverRejectsUnauthenticated(t *testing.T) {
+	addr, shutdown := startFakeDNSServer(t, false)
+	defer shutdown()
+
+	r := NewMiekgResolver(WithServers(addr), WithEDNS0(defaultEdns0BufSize, true), WithRetries(0))
+	if _, err := r.LookupTXT(context.Background(), "example.com"); err == nil {
+		t.Fatal("expected an error for an unauthenticated answer when DNSSEC was requested")
+	}
+}
+
+//TestMiekgResolverAcceptsAuthenticated checks that a genuinely authenticated
+//answer is still returned normally
+func TestMiekgResolverAcceptsAuthenticated(t *testing.T) {
+	addr, shutdown := startFakeDNSServer(t, true)
+	defer shutdown()
+
+	r := NewMiekgResolver(WithServers(addr), WithEDNS0(defaultEdns0BufSize, true), WithRetries(0))
+	txts, err := r.LookupTXT(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(txts) != 1 || txts[0] != "hello" {
+		t.Fatalf("unexpected txts: %v", txts)
+	}
+}
@@ -0,0 +1,127 @@
+package ipisp
+
+import "net"
+
+//prefixTrie is a binary trie over IP prefix bits, keyed by an arbitrary
+//string per inserted range. It answers "which stored prefixes contain this
+//IP" in time proportional to the address width (32 bits for IPv4, 128 for
+//IPv6) rather than the number of prefixes stored, which is what lets the
+//cache's bolt and LRU tiers stay fast once Prewarm has loaded a full RIB
+//dump's worth of entries
+type prefixTrie struct {
+	root *prefixTrieNode
+}
+
+type prefixTrieNode struct {
+	children [2]*prefixTrieNode
+	key      string
+	hasValue bool
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{root: &prefixTrieNode{}}
+}
+
+//insert registers key against rng, so a later matchPath call for any IP
+//inside rng will include key among its results
+func (t *prefixTrie) insert(rng *net.IPNet, key string) {
+	bits := rangeBits(rng)
+	if bits == nil {
+		return
+	}
+
+	n := t.root
+	for _, bit := range bits {
+		if n.children[bit] == nil {
+			n.children[bit] = &prefixTrieNode{}
+		}
+		n = n.children[bit]
+	}
+	n.key = key
+	n.hasValue = true
+}
+
+//remove undoes a prior insert for rng; it's a no-op if rng was never inserted
+func (t *prefixTrie) remove(rng *net.IPNet) {
+	bits := rangeBits(rng)
+	if bits == nil {
+		return
+	}
+
+	n := t.root
+	for _, bit := range bits {
+		n = n.children[bit]
+		if n == nil {
+			return
+		}
+	}
+	n.key = ""
+	n.hasValue = false
+}
+
+//matchPath returns the key of every stored prefix containing ip, ordered
+//from most specific (longest) to least specific. A trie node's path from
+//the root encodes a prefix exactly, so any node with a value along ip's
+//own root-to-leaf walk is, by construction, a prefix that contains ip
+func (t *prefixTrie) matchPath(ip net.IP) []string {
+	bits := addrBits(ip)
+	if bits == nil {
+		return nil
+	}
+
+	n := t.root
+	var matches []string
+	if n.hasValue {
+		matches = append(matches, n.key)
+	}
+	for _, bit := range bits {
+		n = n.children[bit]
+		if n == nil {
+			break
+		}
+		if n.hasValue {
+			matches = append(matches, n.key)
+		}
+	}
+
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
+
+//addrBits renders ip as a family marker bit (0 for IPv4, 1 for IPv6)
+//followed by its address bits, most significant first. The marker bit
+//keeps IPv4 and IPv6 prefixes in disjoint parts of the trie even though an
+//IPv4-mapped address would otherwise share a bit pattern with some IPv6 one
+func addrBits(ip net.IP) []int {
+	if v4 := ip.To4(); v4 != nil {
+		return byteBits(0, v4)
+	}
+	if v6 := ip.To16(); v6 != nil {
+		return byteBits(1, v6)
+	}
+	return nil
+}
+
+//rangeBits is addrBits truncated to rng's own mask length, i.e. the bits a
+//trie lookup needs to match for an address to be considered inside rng
+func rangeBits(rng *net.IPNet) []int {
+	bits := addrBits(rng.IP)
+	if bits == nil {
+		return nil
+	}
+	ones, _ := rng.Mask.Size()
+	return bits[:1+ones]
+}
+
+func byteBits(family int, addr []byte) []int {
+	bits := make([]int, 0, 1+len(addr)*8)
+	bits = append(bits, family)
+	for _, b := range addr {
+		for i := 7; i >= 0; i-- {
+			bits = append(bits, int((b>>uint(i))&1))
+		}
+	}
+	return bits
+}
@@ -0,0 +1,67 @@
+package ipisp
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, rng, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rng
+}
+
+//TestPrefixTrieMostSpecificFirst guards against matchPath returning hits in
+//insertion order rather than most-specific-first: a cache Lookup relies on
+//the first usable result being the longest matching prefix
+func TestPrefixTrieMostSpecificFirst(t *testing.T) {
+	trie := newPrefixTrie()
+	trie.insert(mustParseCIDR(t, "10.0.0.0/8"), "10.0.0.0/8")
+	trie.insert(mustParseCIDR(t, "10.1.0.0/16"), "10.1.0.0/16")
+	trie.insert(mustParseCIDR(t, "10.1.2.0/24"), "10.1.2.0/24")
+
+	got := trie.matchPath(net.ParseIP("10.1.2.3"))
+	want := []string{"10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8"}
+	if len(got) != len(want) {
+		t.Fatalf("matchPath = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("matchPath = %v, want %v", got, want)
+		}
+	}
+}
+
+//TestPrefixTrieDisjointFamilies guards against an IPv4 address and an
+//IPv6 address that happen to share a bit pattern (e.g. via IPv4-mapped
+//notation) matching each other's prefixes
+func TestPrefixTrieDisjointFamilies(t *testing.T) {
+	trie := newPrefixTrie()
+	trie.insert(mustParseCIDR(t, "0.0.0.0/8"), "v4")
+	trie.insert(mustParseCIDR(t, "::/8"), "v6")
+
+	if got := trie.matchPath(net.ParseIP("0.1.2.3")); len(got) != 1 || got[0] != "v4" {
+		t.Fatalf("matchPath(0.1.2.3) = %v, want [v4]", got)
+	}
+	if got := trie.matchPath(net.ParseIP("1:203::")); len(got) != 1 || got[0] != "v6" {
+		t.Fatalf("matchPath(1:203::) = %v, want [v6]", got)
+	}
+}
+
+//TestPrefixTrieRemove guards against remove leaving a stale match behind,
+//which matters for lruCache eviction: an evicted entry's key must stop
+//showing up in matchPath results even though the trie node it lived on may
+//still be shared with other prefixes
+func TestPrefixTrieRemove(t *testing.T) {
+	trie := newPrefixTrie()
+	rng := mustParseCIDR(t, "192.168.0.0/16")
+	trie.insert(rng, "192.168.0.0/16")
+	trie.remove(rng)
+
+	if got := trie.matchPath(net.ParseIP("192.168.1.1")); len(got) != 0 {
+		t.Fatalf("matchPath after remove = %v, want none", got)
+	}
+}
@@ -0,0 +1,46 @@
+package ipisp
+
+import (
+	"context"
+	"net"
+)
+
+//Resolver performs the raw TXT lookups dnsClient builds its responses from.
+//It exists so callers can swap in a resolver that talks to a specific
+//nameserver, tunes EDNS0 behaviour, or otherwise differs from however the
+//host operating system resolves DNS by default
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+//goResolver adapts *net.Resolver, the Go stdlib's own lookup path, to the
+//Resolver interface. It is the default used by NewDnsClient
+type goResolver struct {
+	r *net.Resolver
+}
+
+func (g *goResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return g.r.LookupTXT(ctx, name)
+}
+
+//Option configures a dnsClient constructed by NewDnsClient
+type Option func(*dnsClient)
+
+//WithResolver overrides the Resolver dnsClient issues TXT lookups through,
+//e.g. to query a specific nameserver via NewMiekgResolver
+func WithResolver(r Resolver) Option {
+	return func(c *dnsClient) {
+		c.resolver = r
+	}
+}
+
+//PreferGo forces dnsClient back onto the Go stdlib resolver, mirroring
+//net.Resolver.PreferGo. Supplied after WithResolver in the opts list, it
+//takes precedence over whichever Resolver that option selected
+func PreferGo(prefer bool) Option {
+	return func(c *dnsClient) {
+		if prefer {
+			c.resolver = &goResolver{r: &net.Resolver{PreferGo: true}}
+		}
+	}
+}
@@ -5,9 +5,10 @@ package ipisp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -75,11 +76,16 @@ func (c *whoisClient) Close() error {
 	return c.conn.Close()
 }
 
-//LookupIPs looks up IPs and returns a slice of responses the same size as the input slice of IPs
-//The response slice will be in the same order as the input IPs
+//LookupIPs is a context.Background() proxy of LookupIPsContext
 func (c *whoisClient) LookupIPs(ips []net.IP) (resp []Response, err error) {
-	resp = make([]Response, 0, len(ips))
+	return c.LookupIPsContext(context.Background(), ips)
+}
 
+//LookupIPsContext looks up IPs and returns a slice of responses the same size as the input slice of IPs
+//The response slice will be in the same order as the input IPs
+//If ctx is cancelled before every response has been read, the outstanding read is aborted and
+//LookupIPsContext returns ctx.Err()
+func (c *whoisClient) LookupIPsContext(ctx context.Context, ips []net.IP) (resp []Response, err error) {
 	c.ncmu.Lock()
 	defer c.ncmu.Unlock()
 	for _, ip := range ips {
@@ -89,81 +95,168 @@ func (c *whoisClient) LookupIPs(ips []net.IP) (resp []Response, err error) {
 			return resp, err
 		}
 	}
-	//Raw response
-	var raw []byte
-	var tokens [][]byte
-	var asn int
+	return c.readIPResponses(ctx, ips)
+}
 
-	var finished bool
+//readIPResponses runs the blocking Cymru scan in a goroutine and races it against ctx.Done(),
+//following the pattern used by the net package's lookup goroutines: if ctx is cancelled first,
+//it sets a read deadline on c.conn so the in-flight Scan() returns promptly
+func (c *whoisClient) readIPResponses(ctx context.Context, ips []net.IP) (resp []Response, err error) {
+	type result struct {
+		resp []Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, e := c.scanIPResponses(ips)
+		done <- result{r, e}
+	}()
+
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-ctx.Done():
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+		return resp, ctx.Err()
+	}
+}
+
+//scanIPResponses reads len(ips) response lines and keys each one by its echoed IP, since
+//Cymru's netcat interface doesn't guarantee replying in submission order, then builds the
+//result slice back up in the order ips was given in. It reads exactly len(ips) lines rather
+//than stopping once byIP has len(ips) keys, since a duplicate IP in the batch collapses to a
+//single map key and would otherwise leave the scan waiting on a line Cymru already sent
+func (c *whoisClient) scanIPResponses(ips []net.IP) (resp []Response, err error) {
+	byIP := make(map[string]Response, len(ips))
 
-	//Read results
-	for !finished && c.sc.Scan() {
+	var raw []byte
 
+	for got := 0; got < len(ips); got++ {
+		if !c.sc.Scan() {
+			break
+		}
 		raw = c.sc.Bytes()
 		if bytes.HasPrefix(raw, []byte("Error: ")) {
-			return resp, errors.New(string(bytes.TrimSpace(bytes.TrimLeft(raw, "Error: "))))
+			return resp, &CymruError{msg: string(bytes.TrimSpace(bytes.TrimLeft(raw, "Error: ")))}
 		}
-		tokens = bytes.Split(raw, []byte{'|'})
 
-		if len(tokens) != netcatIPTokensLength {
-			return resp, ErrUnexpectedTokens
+		re, perr := parseWhoisLine(lookupKindIP, raw)
+		if perr != nil {
+			return resp, perr
 		}
+		byIP[re.IP.String()] = re
+	}
+	if err = c.sc.Err(); err != nil {
+		return resp, err
+	}
 
-		//Trim excess whitespace from tokens
-		for i := range tokens {
-			tokens[i] = bytes.TrimSpace(tokens[i])
+	resp = make([]Response, len(ips))
+	for i, ip := range ips {
+		re, ok := byIP[ip.String()]
+		if !ok {
+			return resp, fmt.Errorf("No response received for IP %s", ip.String())
 		}
+		resp[i] = re
+	}
+	return resp, nil
+}
 
-		re := Response{}
-
-		//Read ASN
-		if asn, err = strconv.Atoi(string(tokens[0])); err != nil {
-			return
+//LookupIPsStream behaves like LookupIPsContext, except it emits each Response on respCh as
+//soon as it's read rather than buffering the whole batch, which matters for callers looking
+//up millions of addresses who don't want to hold them all in memory at once. It reads exactly
+//len(ips) responses and closes both channels once done, or as soon as ctx is cancelled or an
+//error is encountered
+func (c *whoisClient) LookupIPsStream(ctx context.Context, ips []net.IP) (<-chan Response, <-chan error) {
+	respCh := make(chan Response)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(respCh)
+		defer close(errCh)
+
+		c.ncmu.Lock()
+		defer c.ncmu.Unlock()
+
+		for _, ip := range ips {
+			c.w.WriteString(ip.String())
+			c.w.Write(ncEOL)
+			if err := c.w.Flush(); err != nil {
+				errCh <- err
+				return
+			}
 		}
-		re.ASN = ASN(asn)
-
-		//Read IP
-		re.IP = net.ParseIP(string(tokens[1]))
 
-		//Read range
-		if _, re.Range, err = net.ParseCIDR(string(tokens[2])); err != nil {
-			return
+		streamDone := make(chan struct{})
+		defer close(streamDone)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.conn.SetReadDeadline(time.Now())
+			case <-streamDone:
+			}
+		}()
+		defer c.conn.SetReadDeadline(time.Time{})
+
+		for i := 0; i < len(ips); i++ {
+			if !c.sc.Scan() {
+				if ctx.Err() != nil {
+					errCh <- ctx.Err()
+				} else if err := c.sc.Err(); err != nil {
+					errCh <- err
+				} else {
+					errCh <- fmt.Errorf("whois: connection closed before all responses were received")
+				}
+				return
+			}
+
+			raw := c.sc.Bytes()
+			if bytes.HasPrefix(raw, []byte("Error: ")) {
+				errCh <- &CymruError{msg: string(bytes.TrimSpace(bytes.TrimLeft(raw, "Error: ")))}
+				return
+			}
+
+			resp, err := parseWhoisLine(lookupKindIP, raw)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case respCh <- resp:
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
 		}
+	}()
 
-		//Read country
-		re.Country, _ = NewCountryFromCode(string(tokens[3]))
-
-		//Read registry
-		re.Registry = string(tokens[4])
-
-		//Read allocated. Ignore error as a lot of entries don't have an allocated value.
-		re.Allocated, _ = time.Parse("2006-01-02", string(tokens[5]))
-
-		//Read name
-		re.Name = NewName(string(tokens[6]))
-
-		//Add to response slice
-		resp = append(resp, re)
-		if len(resp) == cap(resp) {
-			finished = true
-		}
-	}
-	return resp, err
+	return respCh, errCh
 }
 
-//LookupIP is a single IP convenience proxy of LookupIPs
+//LookupIP is a context.Background() proxy of LookupIPContext
 func (c *whoisClient) LookupIP(ip net.IP) (*Response, error) {
-	resp, err := c.LookupIPs([]net.IP{ip})
+	return c.LookupIPContext(context.Background(), ip)
+}
+
+//LookupIPContext is a single IP convenience proxy of LookupIPsContext
+func (c *whoisClient) LookupIPContext(ctx context.Context, ip net.IP) (*Response, error) {
+	resp, err := c.LookupIPsContext(ctx, []net.IP{ip})
 	if len(resp) == 0 {
 		return nil, err
 	}
 	return &resp[0], err
 }
 
-//LookupASNs looks up ASNs. Response IP and Range fields are zeroed
+//LookupASNs is a context.Background() proxy of LookupASNsContext
 func (c *whoisClient) LookupASNs(asns []ASN) (resp []Response, err error) {
-	resp = make([]Response, 0, len(asns))
+	return c.LookupASNsContext(context.Background(), asns)
+}
 
+//LookupASNsContext looks up ASNs. Response IP and Range fields are zeroed
+//If ctx is cancelled before every response has been read, the outstanding read is aborted and
+//LookupASNsContext returns ctx.Err()
+func (c *whoisClient) LookupASNsContext(ctx context.Context, asns []ASN) (resp []Response, err error) {
 	c.ncmu.Lock()
 	defer c.ncmu.Unlock()
 	for _, asn := range asns {
@@ -174,61 +267,83 @@ func (c *whoisClient) LookupASNs(asns []ASN) (resp []Response, err error) {
 		}
 	}
 
-	//Raw response
-	var raw []byte
-	var tokens [][]byte
-	var asn int
+	return c.readASNResponses(ctx, asns)
+}
 
-	var finished bool
+//readASNResponses races the blocking Cymru scan against ctx.Done(), forcing the in-flight
+//Scan() to return via a read deadline on c.conn if ctx is cancelled first
+func (c *whoisClient) readASNResponses(ctx context.Context, asns []ASN) (resp []Response, err error) {
+	type result struct {
+		resp []Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, e := c.scanASNResponses(asns)
+		done <- result{r, e}
+	}()
+
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-ctx.Done():
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+		return resp, ctx.Err()
+	}
+}
 
-	//Read results
-	for !finished && c.sc.Scan() {
-		raw = c.sc.Bytes()
-		if bytes.HasPrefix(raw, []byte("Error: ")) {
-			return resp, errors.New(string(bytes.TrimSpace(bytes.TrimLeft(raw, "Error: "))))
-		}
-		tokens = bytes.Split(raw, []byte{'|'})
+//scanASNResponses reads len(asns) response lines and keys each one by its echoed ASN, since
+//Cymru's netcat interface doesn't guarantee replying in submission order, then builds the
+//result slice back up in the order asns was given in. It reads exactly len(asns) lines rather
+//than stopping once byASN has len(asns) keys, since a duplicate ASN in the batch collapses to
+//a single map key and would otherwise leave the scan waiting on a line Cymru already sent
+func (c *whoisClient) scanASNResponses(asns []ASN) (resp []Response, err error) {
+	byASN := make(map[ASN]Response, len(asns))
 
-		if len(tokens) != netcatASNTokensLength {
-			return resp, ErrUnexpectedTokens
-		}
+	var raw []byte
 
-		//Trim excess whitespace from tokens
-		for i := range tokens {
-			tokens[i] = bytes.TrimSpace(tokens[i])
+	for got := 0; got < len(asns); got++ {
+		if !c.sc.Scan() {
+			break
 		}
-
-		re := Response{}
-
-		//Read ASN
-		if asn, err = strconv.Atoi(string(tokens[0])); err != nil {
-			return
+		raw = c.sc.Bytes()
+		if bytes.HasPrefix(raw, []byte("Error: ")) {
+			return resp, &CymruError{msg: string(bytes.TrimSpace(bytes.TrimLeft(raw, "Error: ")))}
 		}
-		re.ASN = ASN(asn)
-
-		//Read country
-		re.Country, _ = NewCountryFromCode(string(tokens[1]))
-
-		//Read registry
-		re.Registry = string(tokens[2])
 
-		//Read allocated. Ignore error as a lot of entries don't have an allocated value.
-		re.Allocated, _ = time.Parse("2006-01-02", string(tokens[3]))
-
-		//Read name
-		re.Name = NewName(string(tokens[4]))
+		re, perr := parseWhoisLine(lookupKindASN, raw)
+		if perr != nil {
+			return resp, perr
+		}
+		byASN[re.ASN] = re
+	}
+	if err = c.sc.Err(); err != nil {
+		return resp, err
+	}
 
-		//Add to response slice
-		resp = append(resp, re)
-		if len(resp) == cap(resp) {
-			finished = true
+	resp = make([]Response, len(asns))
+	for i, asn := range asns {
+		re, ok := byASN[asn]
+		if !ok {
+			return resp, fmt.Errorf("No response received for ASN %s", asn.String())
 		}
+		resp[i] = re
 	}
-	return resp, err
+	return resp, nil
 }
 
-//LookupASN is a single ASN convenience proxy of LookupASNs
+//LookupASN is a context.Background() proxy of LookupASNContext
 func (c *whoisClient) LookupASN(asn ASN) (*Response, error) {
-	resp, err := c.LookupASNs([]ASN{asn})
+	return c.LookupASNContext(context.Background(), asn)
+}
+
+//LookupASNContext is a single ASN convenience proxy of LookupASNsContext
+func (c *whoisClient) LookupASNContext(ctx context.Context, asn ASN) (*Response, error) {
+	resp, err := c.LookupASNsContext(ctx, []ASN{asn})
+	if len(resp) == 0 {
+		return nil, err
+	}
 	return &resp[0], err
 }
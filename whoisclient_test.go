@@ -0,0 +1,202 @@
+package ipisp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//newTestWhoisClient builds a whoisClient around an already-connected conn,
+//bypassing NewWhoisClient's hardcoded dial to Cymru so tests can hand it a
+//loopback connection instead
+func newTestWhoisClient(conn net.Conn) *whoisClient {
+	return &whoisClient{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+		sc:   bufio.NewScanner(conn),
+		ncmu: &sync.Mutex{},
+	}
+}
+
+//newLoopbackConnPair returns a connected pair of TCP sockets over the
+//loopback interface. Unlike net.Pipe, a real socket has kernel-buffered
+//writes: a fake server that replies to each line as it reads it, while a
+//caller writes its whole batch before reading anything back, would
+//deadlock over net.Pipe's synchronous, unbuffered Read/Write rendezvous as
+//soon as the batch held more than one item
+func newLoopbackConnPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverCh := make(chan net.Conn, 1)
+	acceptErrCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptErrCh <- err
+			return
+		}
+		serverCh <- conn
+	}()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case server = <-serverCh:
+	case err := <-acceptErrCh:
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+//fakeWhoisServer stands in for Cymru's netcat interface: it echoes back one
+//response line per line it reads, in the order it reads them, which is all
+//scanIPResponses/scanASNResponses require to make progress
+func fakeWhoisServer(conn net.Conn, kind lookupKind) {
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		target := strings.TrimSpace(sc.Text())
+		if kind == lookupKindIP {
+			fmt.Fprintf(conn, "15169 | %s | 8.8.8.0/24 | US | arin | 1992-12-01 | GOOGLE\r\n", target)
+		} else {
+			//Cymru echoes an ASN as a bare number, not the "ASnnnn" form it was asked for in
+			fmt.Fprintf(conn, "%s | US | arin | 1992-12-01 | GOOGLE\r\n", strings.TrimPrefix(target, "AS"))
+		}
+	}
+}
+
+//TestWhoisClientLookupIPsDuplicate guards against scanIPResponses hanging
+//when the same IP appears twice in a batch: two echoed lines collapse into
+//one byIP key, so counting keys instead of lines read never reaches "done"
+func TestWhoisClientLookupIPsDuplicate(t *testing.T) {
+	client, server := newLoopbackConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	go fakeWhoisServer(server, lookupKindIP)
+
+	c := newTestWhoisClient(client)
+	ips := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}
+
+	done := make(chan struct{})
+	var resp []Response
+	var err error
+	go func() {
+		resp, err = c.LookupIPsContext(context.Background(), ips)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("LookupIPsContext hung on a duplicate IP in the batch")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp) != len(ips) {
+		t.Fatalf("expected %d responses, got %d", len(ips), len(resp))
+	}
+}
+
+//TestWhoisClientLookupASNsDuplicate is the ASN-side analogue of
+//TestWhoisClientLookupIPsDuplicate
+func TestWhoisClientLookupASNsDuplicate(t *testing.T) {
+	client, server := newLoopbackConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	go fakeWhoisServer(server, lookupKindASN)
+
+	c := newTestWhoisClient(client)
+	asns := []ASN{15169, 15169}
+
+	done := make(chan struct{})
+	var resp []Response
+	var err error
+	go func() {
+		resp, err = c.LookupASNsContext(context.Background(), asns)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("LookupASNsContext hung on a duplicate ASN in the batch")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp) != len(asns) {
+		t.Fatalf("expected %d responses, got %d", len(asns), len(resp))
+	}
+}
+
+//TestWhoisClientLookupIPsContextCancel checks that a cancelled context
+//unblocks an in-flight scan rather than waiting for Cymru to answer
+func TestWhoisClientLookupIPsContextCancel(t *testing.T) {
+	client, server := newLoopbackConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	//server never replies, so without cancellation this would block forever
+	go func() {
+		sc := bufio.NewScanner(server)
+		for sc.Scan() {
+		}
+	}()
+
+	c := newTestWhoisClient(client)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	var err error
+	go func() {
+		_, err = c.LookupIPsContext(ctx, []net.IP{net.ParseIP("8.8.8.8")})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("LookupIPsContext did not honor context cancellation")
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+//TestWhoisClientCymruError checks that a bare "Error: ..." response line
+//surfaces as a *CymruError, the type cachingClient relies on to tell a
+//genuine Cymru negative response apart from a transport or context error
+func TestWhoisClientCymruError(t *testing.T) {
+	client, server := newLoopbackConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		sc := bufio.NewScanner(server)
+		if sc.Scan() {
+			fmt.Fprint(server, "Error: no such IP\r\n")
+		}
+	}()
+
+	c := newTestWhoisClient(client)
+	_, err := c.LookupIPContext(context.Background(), net.ParseIP("8.8.8.8"))
+
+	var cymruErr *CymruError
+	if !errors.As(err, &cymruErr) {
+		t.Fatalf("expected a *CymruError, got %T: %v", err, err)
+	}
+}
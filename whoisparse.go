@@ -0,0 +1,77 @@
+package ipisp
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+//lookupKind distinguishes the two line formats Cymru's netcat interface
+//returns: bulk IP lookups and ASN lookups have a different number of
+//pipe-delimited fields, so a response line's own token count identifies it
+type lookupKind int
+
+const (
+	lookupKindIP lookupKind = iota
+	lookupKindASN
+)
+
+//CymruError is Cymru's own negative response to a lookup (a netcat line
+//prefixed "Error: "), as opposed to a transport failure or a cancelled
+//context. It's the only kind of lookup failure that's safe to negatively
+//cache: the target genuinely doesn't exist as far as Cymru is concerned,
+//rather than us having simply failed to ask in time
+type CymruError struct {
+	msg string
+}
+
+func (e *CymruError) Error() string { return e.msg }
+
+//parseWhoisLine parses a single pipe-delimited Cymru response line into a
+//Response. It's shared by whoisClient's own scanning and by whoisPool, so
+//both correlate responses back to requests the same way
+func parseWhoisLine(kind lookupKind, raw []byte) (Response, error) {
+	tokens := bytes.Split(raw, []byte{'|'})
+	for i := range tokens {
+		tokens[i] = bytes.TrimSpace(tokens[i])
+	}
+
+	re := Response{}
+
+	switch kind {
+	case lookupKindIP:
+		if len(tokens) != netcatIPTokensLength {
+			return re, ErrUnexpectedTokens
+		}
+		asn, err := strconv.Atoi(string(tokens[0]))
+		if err != nil {
+			return re, err
+		}
+		re.ASN = ASN(asn)
+		re.IP = net.ParseIP(string(tokens[1]))
+		if _, re.Range, err = net.ParseCIDR(string(tokens[2])); err != nil {
+			return re, err
+		}
+		re.Country, _ = NewCountryFromCode(string(tokens[3]))
+		re.Registry = string(tokens[4])
+		re.Allocated, _ = time.Parse("2006-01-02", string(tokens[5]))
+		re.Name = NewName(string(tokens[6]))
+
+	case lookupKindASN:
+		if len(tokens) != netcatASNTokensLength {
+			return re, ErrUnexpectedTokens
+		}
+		asn, err := strconv.Atoi(string(tokens[0]))
+		if err != nil {
+			return re, err
+		}
+		re.ASN = ASN(asn)
+		re.Country, _ = NewCountryFromCode(string(tokens[1]))
+		re.Registry = string(tokens[2])
+		re.Allocated, _ = time.Parse("2006-01-02", string(tokens[3]))
+		re.Name = NewName(string(tokens[4]))
+	}
+
+	return re, nil
+}
@@ -0,0 +1,419 @@
+package ipisp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//WhoisPoolOption configures a whoisPool constructed by NewWhoisPool
+type WhoisPoolOption func(*whoisPool)
+
+//WithPoolTimeout overrides the dial timeout used when establishing, and
+//later re-establishing, pooled connections. It defaults to Timeout
+func WithPoolTimeout(d time.Duration) WhoisPoolOption {
+	return func(p *whoisPool) {
+		p.timeout = d
+	}
+}
+
+const poolQueueSize = 64
+
+type poolRequest struct {
+	kind lookupKind
+	//target is what's written to the wire
+	target string
+	//key is what the response is correlated back to this request by; it
+	//matches the token Cymru echoes in the response line, which for ASN
+	//lookups is a bare number rather than target's "ASnnnn" form
+	key    string
+	result chan poolResult
+}
+
+type poolResult struct {
+	resp Response
+	err  error
+}
+
+//whoisPool maintains a pool of established Cymru netcat connections and
+//spreads lookups across them. Each connection pipelines its own writes and
+//reads via dedicated goroutines, so a batch of lookups isn't serialized
+//behind a single socket and a single caller the way whoisClient is
+type whoisPool struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	conns []*poolConn
+	next  uint64
+}
+
+//NewWhoisPool dials size Cymru netcat connections, each pre-negotiated with
+//begin/verbose, and returns a pool that dispatches lookups across them
+func NewWhoisPool(size int, opts ...WhoisPoolOption) (*whoisPool, error) {
+	if size < 1 {
+		return nil, errors.New("whois pool: size must be at least 1")
+	}
+
+	p := &whoisPool{timeout: Timeout}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.conns = make([]*poolConn, size)
+	for i := range p.conns {
+		pc, err := dialPoolConn(p.timeout)
+		if err != nil {
+			return nil, err
+		}
+		p.conns[i] = pc
+	}
+	return p, nil
+}
+
+//Close tears down every pooled connection
+func (p *whoisPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	for _, pc := range p.conns {
+		if err := pc.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//conn returns a live pooled connection, transparently redialing any that
+//Cymru has dropped since the last lookup
+func (p *whoisPool) conn(idx int) (*poolConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc := p.conns[idx]
+	select {
+	case <-pc.dead:
+		fresh, err := dialPoolConn(p.timeout)
+		if err != nil {
+			return nil, err
+		}
+		p.conns[idx] = fresh
+		return fresh, nil
+	default:
+		return pc, nil
+	}
+}
+
+func (p *whoisPool) nextConn() (*poolConn, error) {
+	idx := int(atomic.AddUint64(&p.next, 1) % uint64(len(p.conns)))
+	return p.conn(idx)
+}
+
+//LookupIPs looks up IPs, splitting the batch across the pool's connections,
+//and returns a slice of responses the same size as, and in the same order
+//as, the input slice of IPs, regardless of the order Cymru answers in
+func (p *whoisPool) LookupIPs(ips []net.IP) ([]Response, error) {
+	results := make([]chan poolResult, len(ips))
+	for i, ip := range ips {
+		pc, err := p.nextConn()
+		if err != nil {
+			return nil, err
+		}
+		result := make(chan poolResult, 1)
+		results[i] = result
+		pc.reqs <- poolRequest{kind: lookupKindIP, target: ip.String(), key: ip.String(), result: result}
+	}
+
+	resp := make([]Response, len(ips))
+	var firstErr error
+	for i, result := range results {
+		res := <-result
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
+		}
+		resp[i] = res.resp
+	}
+	return resp, firstErr
+}
+
+//LookupIP is a single IP convenience proxy of LookupIPs
+func (p *whoisPool) LookupIP(ip net.IP) (*Response, error) {
+	resp, err := p.LookupIPs([]net.IP{ip})
+	if len(resp) == 0 {
+		return nil, err
+	}
+	return &resp[0], err
+}
+
+//LookupASNs looks up ASNs, splitting the batch across the pool's
+//connections. Response IP and Range fields are zeroed
+func (p *whoisPool) LookupASNs(asns []ASN) ([]Response, error) {
+	results := make([]chan poolResult, len(asns))
+	for i, asn := range asns {
+		pc, err := p.nextConn()
+		if err != nil {
+			return nil, err
+		}
+		result := make(chan poolResult, 1)
+		results[i] = result
+		pc.reqs <- poolRequest{kind: lookupKindASN, target: asn.String(), key: strconv.Itoa(int(asn)), result: result}
+	}
+
+	resp := make([]Response, len(asns))
+	var firstErr error
+	for i, result := range results {
+		res := <-result
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
+		}
+		resp[i] = res.resp
+	}
+	return resp, firstErr
+}
+
+//LookupASN is a single ASN convenience proxy of LookupASNs
+func (p *whoisPool) LookupASN(asn ASN) (*Response, error) {
+	resp, err := p.LookupASNs([]ASN{asn})
+	if len(resp) == 0 {
+		return nil, err
+	}
+	return &resp[0], err
+}
+
+//poolConn is a single pooled Cymru netcat connection. Its writer goroutine
+//flushes queued targets as they arrive; its reader goroutine parses the
+//pipe-delimited response lines as they come back and matches each one to
+//its outstanding request by the IP or ASN token Cymru echoes back, since
+//the netcat interface doesn't guarantee replying in submission order.
+//Pending requests are kept per key in submission order rather than one per
+//key, since a batch routed onto this connection can legitimately contain
+//the same IP or ASN more than once; each echoed line is matched to the
+//oldest still-outstanding request for that key
+type poolConn struct {
+	conn net.Conn
+	w    *bufio.Writer
+	sc   *bufio.Scanner
+
+	reqs chan poolRequest
+	dead chan struct{}
+	once sync.Once
+
+	pendingMu  sync.Mutex
+	pendingIP  map[string][]poolRequest
+	pendingASN map[string][]poolRequest
+}
+
+func dialPoolConn(timeout time.Duration) (*poolConn, error) {
+	conn, err := net.DialTimeout("tcp", cymruNetcatAddress, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &poolConn{
+		conn:       conn,
+		w:          bufio.NewWriter(conn),
+		sc:         bufio.NewScanner(conn),
+		reqs:       make(chan poolRequest, poolQueueSize),
+		dead:       make(chan struct{}),
+		pendingIP:  make(map[string][]poolRequest),
+		pendingASN: make(map[string][]poolRequest),
+	}
+
+	pc.w.Write([]byte("begin"))
+	pc.w.Write(ncEOL)
+	pc.w.Write([]byte("verbose"))
+	pc.w.Write(ncEOL)
+	if err = pc.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	//Discard first hello line
+	pc.sc.Scan()
+	if err = pc.sc.Err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go pc.writeLoop()
+	go pc.readLoop()
+	return pc, nil
+}
+
+func (pc *poolConn) close() error {
+	pc.w.Write([]byte("end"))
+	pc.w.Write(ncEOL)
+	pc.w.Flush()
+	return pc.conn.Close()
+}
+
+func (pc *poolConn) markDead() {
+	pc.once.Do(func() { close(pc.dead) })
+}
+
+func (pc *poolConn) writeLoop() {
+	for {
+		select {
+		case req := <-pc.reqs:
+			//Register before writing to the wire, not after flushing: readLoop
+			//runs concurrently, and if the request were only registered after
+			//the flush, its response could be read and matched (or dropped as
+			//unsolicited) before there was anywhere to deliver it, with the
+			//*next* request's response then wrongly matching this one's
+			//now-stale pending entry
+			pc.registerPending(req)
+
+			pc.w.WriteString(req.target)
+			pc.w.Write(ncEOL)
+			if err := pc.w.Flush(); err != nil {
+				pc.removePending(req)
+				req.result <- poolResult{err: err}
+				pc.markDead()
+				return
+			}
+		case <-pc.dead:
+			return
+		}
+	}
+}
+
+//registerPending records req as outstanding before its target is written to
+//the wire, so a response can never arrive for it before there's somewhere
+//to deliver the result
+func (pc *poolConn) registerPending(req poolRequest) {
+	pc.pendingMu.Lock()
+	if req.kind == lookupKindIP {
+		pc.pendingIP[req.key] = append(pc.pendingIP[req.key], req)
+	} else {
+		pc.pendingASN[req.key] = append(pc.pendingASN[req.key], req)
+	}
+	pc.pendingMu.Unlock()
+}
+
+//removePending undoes registerPending for a request whose target never
+//made it onto the wire (a failed Flush), so a response that will now never
+//arrive doesn't leave it stuck in the pending queue forever
+func (pc *poolConn) removePending(req poolRequest) {
+	pc.pendingMu.Lock()
+	defer pc.pendingMu.Unlock()
+
+	pending := pc.pendingIP
+	if req.kind == lookupKindASN {
+		pending = pc.pendingASN
+	}
+
+	queue := pending[req.key]
+	for i, queued := range queue {
+		if queued.result == req.result {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(pending, req.key)
+	} else {
+		pending[req.key] = queue
+	}
+}
+
+func (pc *poolConn) readLoop() {
+	for pc.sc.Scan() {
+		raw := pc.sc.Bytes()
+
+		if bytes.HasPrefix(raw, []byte("Error: ")) {
+			//A bare "Error: ..." line doesn't echo back a target, so there's
+			//no way to tell which outstanding request it belongs to; fail
+			//everything still queued on this connection and let callers retry
+			pc.failPending(&CymruError{msg: string(bytes.TrimSpace(bytes.TrimLeft(raw, "Error: ")))})
+			continue
+		}
+
+		kind, key, ok := poolResponseKey(raw)
+		if !ok {
+			pc.failPending(ErrUnexpectedTokens)
+			continue
+		}
+
+		req, ok := pc.popPending(kind, key)
+		if !ok {
+			//Unsolicited, or already-delivered, response: nothing to match it to
+			continue
+		}
+
+		resp, err := parseWhoisLine(kind, raw)
+		req.result <- poolResult{resp: resp, err: err}
+	}
+
+	//Cymru dropped the socket or the read otherwise failed: fail every
+	//request still queued for this connection rather than let callers hang
+	//on it, and mark it dead so the pool redials on the next lookup
+	err := pc.sc.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	pc.markDead()
+	pc.failPending(err)
+}
+
+//popPending removes and returns the oldest still-outstanding request for
+//kind and key, which is the one the next echoed line for that key belongs to
+func (pc *poolConn) popPending(kind lookupKind, key string) (poolRequest, bool) {
+	pc.pendingMu.Lock()
+	defer pc.pendingMu.Unlock()
+
+	pending := pc.pendingIP
+	if kind == lookupKindASN {
+		pending = pc.pendingASN
+	}
+
+	queue, ok := pending[key]
+	if !ok || len(queue) == 0 {
+		return poolRequest{}, false
+	}
+	req := queue[0]
+	if len(queue) == 1 {
+		delete(pending, key)
+	} else {
+		pending[key] = queue[1:]
+	}
+	return req, true
+}
+
+func (pc *poolConn) failPending(err error) {
+	pc.pendingMu.Lock()
+	defer pc.pendingMu.Unlock()
+
+	for k, queue := range pc.pendingIP {
+		for _, req := range queue {
+			req.result <- poolResult{err: err}
+		}
+		delete(pc.pendingIP, k)
+	}
+	for k, queue := range pc.pendingASN {
+		for _, req := range queue {
+			req.result <- poolResult{err: err}
+		}
+		delete(pc.pendingASN, k)
+	}
+}
+
+//poolResponseKey identifies the lookupKind of a response line from its
+//token count and extracts the token it can be correlated back to a
+//request by: the echoed IP for bulk IP lookups, the echoed ASN otherwise
+func poolResponseKey(raw []byte) (kind lookupKind, key string, ok bool) {
+	tokens := bytes.Split(raw, []byte{'|'})
+	switch len(tokens) {
+	case netcatIPTokensLength:
+		return lookupKindIP, string(bytes.TrimSpace(tokens[1])), true
+	case netcatASNTokensLength:
+		return lookupKindASN, string(bytes.TrimSpace(tokens[0])), true
+	default:
+		return 0, "", false
+	}
+}
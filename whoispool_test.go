@@ -0,0 +1,98 @@
+package ipisp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+//newTestPoolConn builds a poolConn around an already-connected conn and
+//starts its writer/reader goroutines, bypassing dialPoolConn's hardcoded
+//dial to Cymru so tests can hand it a loopback connection instead
+func newTestPoolConn(conn net.Conn) *poolConn {
+	pc := &poolConn{
+		conn:       conn,
+		w:          bufio.NewWriter(conn),
+		sc:         bufio.NewScanner(conn),
+		reqs:       make(chan poolRequest, poolQueueSize),
+		dead:       make(chan struct{}),
+		pendingIP:  make(map[string][]poolRequest),
+		pendingASN: make(map[string][]poolRequest),
+	}
+	go pc.writeLoop()
+	go pc.readLoop()
+	return pc
+}
+
+//TestPoolConnDuplicateTargets guards against the pending-request maps
+//losing a caller's result when two requests for the same IP land on the
+//same connection: overwriting a single pendingIP[key] entry delivered the
+//first echoed line to the second caller and dropped the first on the floor
+func TestPoolConnDuplicateTargets(t *testing.T) {
+	client, server := newLoopbackConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	go fakeWhoisServer(server, lookupKindIP)
+
+	pc := newTestPoolConn(client)
+
+	results := make([]chan poolResult, 2)
+	for i := range results {
+		result := make(chan poolResult, 1)
+		results[i] = result
+		pc.reqs <- poolRequest{kind: lookupKindIP, target: "8.8.8.8", key: "8.8.8.8", result: result}
+	}
+
+	for i, result := range results {
+		select {
+		case res := <-result:
+			if res.err != nil {
+				t.Fatalf("request %d: unexpected error: %v", i, res.err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("request %d never completed: duplicate target was dropped", i)
+		}
+	}
+}
+
+//TestPoolConnRegistersBeforeWrite drives many distinct targets through a
+//single pooled connection against a server that replies the instant it
+//reads a line. Before writeLoop registered a request in pendingIP/pendingASN
+//before writing it to the wire, readLoop could match (or drop as
+//unsolicited) a response before there was anywhere to deliver it, then
+//wrongly hand the *next* request's response to this one's now-stale pending
+//entry; every request here must come back with its own matching response
+func TestPoolConnRegistersBeforeWrite(t *testing.T) {
+	client, server := newLoopbackConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	go fakeWhoisServer(server, lookupKindIP)
+
+	pc := newTestPoolConn(client)
+
+	const n = 200
+	ips := make([]string, n)
+	results := make([]chan poolResult, n)
+	for i := 0; i < n; i++ {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		result := make(chan poolResult, 1)
+		results[i] = result
+		pc.reqs <- poolRequest{kind: lookupKindIP, target: ips[i], key: ips[i], result: result}
+	}
+
+	for i, result := range results {
+		select {
+		case res := <-result:
+			if res.err != nil {
+				t.Fatalf("request %d (%s): unexpected error: %v", i, ips[i], res.err)
+			}
+			if res.resp.IP.String() != ips[i] {
+				t.Fatalf("request %d: expected response for %s, got %s", i, ips[i], res.resp.IP.String())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %d (%s) never completed", i, ips[i])
+		}
+	}
+}